@@ -4,14 +4,20 @@ package handlers
 // https://github.com/senchalabs/connect
 
 import (
-	"bytes"
-	"encoding/base64"
+	"crypto/subtle"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Internal writer that keeps track of the currently authenticated user.
+//
+// It does not implement http.Hijacker, http.CloseNotifier or http.Pusher
+// itself - those are only ever optional, and wrapUserWriter picks one of the
+// variants below to add exactly the ones the wrapped ResponseWriter supports.
 type userResponseWriter struct {
 	http.ResponseWriter
 	user interface{}
@@ -22,6 +28,103 @@ func (this *userResponseWriter) WrappedWriter() http.ResponseWriter {
 	return this.ResponseWriter
 }
 
+func (this *userResponseWriter) Flush() {
+	flush(this.ResponseWriter)
+}
+
+// isUserResponseWriter marks every wrapper variant below (they all embed
+// *userResponseWriter), so GetUser can find the right layer regardless of
+// which variant was chosen for the current writer.
+func (this *userResponseWriter) isUserResponseWriter() {}
+
+func (this *userResponseWriter) authUser() interface{} {
+	return this.user
+}
+
+// userWriter is satisfied by *userResponseWriter and every wrapper variant
+// below; GetUser uses it to find the layer holding the authenticated user
+// without caring which optional interfaces that layer also implements.
+type userWriter interface {
+	http.ResponseWriter
+	isUserResponseWriter()
+	authUser() interface{}
+}
+
+// The 2^3 combinations of http.Hijacker, http.CloseNotifier and http.Pusher
+// a wrapped ResponseWriter may or may not support, built from the mixins in
+// optional_interfaces.go. Each only forwards the optional interfaces its
+// inner writer actually implements - see wrapUserWriter.
+type (
+	userPlainWriter struct {
+		*userResponseWriter
+	}
+	userHijackWriter struct {
+		*userResponseWriter
+		hijackerMixin
+	}
+	userCloseNotifyWriter struct {
+		*userResponseWriter
+		closeNotifierMixin
+	}
+	userPusherWriter struct {
+		*userResponseWriter
+		pusherMixin
+	}
+	userHijackCloseNotifyWriter struct {
+		*userResponseWriter
+		hijackerMixin
+		closeNotifierMixin
+	}
+	userHijackPusherWriter struct {
+		*userResponseWriter
+		hijackerMixin
+		pusherMixin
+	}
+	userCloseNotifyPusherWriter struct {
+		*userResponseWriter
+		closeNotifierMixin
+		pusherMixin
+	}
+	userHijackCloseNotifyPusherWriter struct {
+		*userResponseWriter
+		hijackerMixin
+		closeNotifierMixin
+		pusherMixin
+	}
+)
+
+// wrapUserWriter wraps w for a single request, choosing the variant above
+// that matches which optional interfaces w itself implements.
+func wrapUserWriter(w http.ResponseWriter, user interface{}) userWriter {
+	core := &userResponseWriter{w, user}
+	_, isHijacker := w.(http.Hijacker)
+	_, isCloseNotifier := w.(http.CloseNotifier)
+	_, isPusher := w.(http.Pusher)
+
+	hj := hijackerMixin{inner: w}
+	cn := closeNotifierMixin{inner: w}
+	ps := pusherMixin{inner: w}
+
+	switch {
+	case isHijacker && isCloseNotifier && isPusher:
+		return &userHijackCloseNotifyPusherWriter{core, hj, cn, ps}
+	case isHijacker && isCloseNotifier:
+		return &userHijackCloseNotifyWriter{core, hj, cn}
+	case isHijacker && isPusher:
+		return &userHijackPusherWriter{core, hj, ps}
+	case isCloseNotifier && isPusher:
+		return &userCloseNotifyPusherWriter{core, cn, ps}
+	case isHijacker:
+		return &userHijackWriter{core, hj}
+	case isCloseNotifier:
+		return &userCloseNotifyWriter{core, cn}
+	case isPusher:
+		return &userPusherWriter{core, ps}
+	default:
+		return &userPlainWriter{core}
+	}
+}
+
 // Writes an unauthorized response to the client, specifying the expected authentication
 // information.
 func Unauthorized(w http.ResponseWriter, realm string) {
@@ -39,10 +142,111 @@ func BadRequest(w http.ResponseWriter, msg string) {
 	w.Write([]byte(msg))
 }
 
+// RateLimiter throttles repeated failed login attempts for a key (typically
+// the remote address combined with the attempted username). Implementations
+// must be safe for concurrent use.
+type RateLimiter interface {
+	// Allow reports whether an attempt for key may proceed.
+	Allow(key string) bool
+	// Failure records a failed attempt for key.
+	Failure(key string)
+	// Success clears any failures tracked for key.
+	Success(key string)
+}
+
+// tokenBucket tracks the remaining attempts for a single key, refilling to
+// limit once window has elapsed since the last refill.
+type tokenBucket struct {
+	tokens     int
+	lastRefill time.Time
+}
+
+// tokenBucketRateLimiter is the default in-memory RateLimiter: each key gets
+// limit attempts per window before Allow starts returning false.
+type tokenBucketRateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewTokenBucketRateLimiter returns a RateLimiter allowing up to limit
+// failed attempts per key within window before throttling it.
+func NewTokenBucketRateLimiter(limit int, window time.Duration) RateLimiter {
+	return &tokenBucketRateLimiter{
+		limit:   limit,
+		window:  window,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (rl *tokenBucketRateLimiter) bucketLocked(key string) *tokenBucket {
+	b, ok := rl.buckets[key]
+	if !ok {
+		// A never-seen key means a new client is showing up; take the
+		// opportunity to sweep buckets that are already due for a refill
+		// (and so carry no useful state) instead of keeping every key ever
+		// seen in memory forever.
+		rl.gcLocked()
+		b = &tokenBucket{tokens: rl.limit, lastRefill: time.Now()}
+		rl.buckets[key] = b
+	}
+	if time.Since(b.lastRefill) >= rl.window {
+		b.tokens = rl.limit
+		b.lastRefill = time.Now()
+	}
+	return b
+}
+
+func (rl *tokenBucketRateLimiter) gcLocked() {
+	now := time.Now()
+	for key, b := range rl.buckets {
+		if now.Sub(b.lastRefill) >= rl.window {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+func (rl *tokenBucketRateLimiter) Allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.bucketLocked(key).tokens > 0
+}
+
+func (rl *tokenBucketRateLimiter) Failure(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if b := rl.bucketLocked(key); b.tokens > 0 {
+		b.tokens--
+	}
+}
+
+func (rl *tokenBucketRateLimiter) Success(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	delete(rl.buckets, key)
+}
+
+// remoteHost strips the ephemeral client port from addr (host:port), so
+// rate limiting keys on the client's address rather than a value that's
+// different for every connection it opens. addr is returned unchanged if it
+// doesn't parse as host:port.
+func remoteHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
 // Returns a Basic Authentication handler, protecting the wrapped handler from
-// being accessed if the authentication function is not successful.
+// being accessed if the authentication function is not successful. limiter
+// may be nil to disable throttling; pass NewTokenBucketRateLimiter for the
+// default behavior of returning 429 after repeated failures for the same
+// remote address and username.
 func BasicAuthHandler(h http.Handler,
-	authFn func(string, string) (interface{}, bool), realm string) http.Handler {
+	authFn func(string, string) (interface{}, bool), realm string, limiter RateLimiter) http.Handler {
 
 	if realm == "" {
 		realm = "Authorization Required"
@@ -60,41 +264,52 @@ func BasicAuthHandler(h http.Handler,
 				Unauthorized(w, realm)
 				return
 			}
-			parts := strings.Split(authInfo, " ")
-			if len(parts) != 2 {
+			scheme, _, _ := strings.Cut(authInfo, " ")
+			if subtle.ConstantTimeCompare([]byte(scheme), []byte("Basic")) != 1 {
 				BadRequest(w, "Bad authorization header")
 				return
 			}
-			scheme := parts[0]
-			creds, err := base64.StdEncoding.DecodeString(parts[1])
-			if err != nil {
+			// r.BasicAuth handles the base64 decoding and is more forgiving of
+			// unusual whitespace than splitting the header by hand.
+			user, pwd, ok := r.BasicAuth()
+			if !ok {
 				BadRequest(w, "Bad credentials encoding")
+				return
 			}
-			index := bytes.Index(creds, []byte(":"))
-			if scheme != "Basic" || index < 0 {
-				BadRequest(w, "Bad authorization header")
+
+			key := remoteHost(r.RemoteAddr) + ":" + user
+			if limiter != nil && !limiter.Allow(key) {
+				http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+				return
 			}
-			user, pwd := string(creds[:index]), string(creds[index+1:])
+
 			udata, ok := authFn(user, pwd)
-			if ok {
-				// Save user data and continue
-				uw := &userResponseWriter{w, udata}
-				h.ServeHTTP(uw, r)
-			} else {
+			if !ok {
+				if limiter != nil {
+					limiter.Failure(key)
+				}
 				Unauthorized(w, realm)
+				return
+			}
+			if limiter != nil {
+				limiter.Success(key)
 			}
+
+			// Save user data and continue
+			uw := wrapUserWriter(w, udata)
+			h.ServeHTTP(uw, r)
 		})
 }
 
 // Return the currently authenticated user. This is the same data that was returned
 // by the authentication function passed to BasicAuthHandler.
 func GetUser(w http.ResponseWriter) (interface{}, bool) {
-	usr, ok := GetResponseWriter(w, func(tst http.ResponseWriter) bool {
-		_, ok := tst.(*userResponseWriter)
+	uw, ok := GetResponseWriter(w, func(tst http.ResponseWriter) bool {
+		_, ok := tst.(userWriter)
 		return ok
 	})
 	if ok {
-		return usr.(*userResponseWriter).user, true
+		return uw.(userWriter).authUser(), true
 	}
 	return nil, false
 }
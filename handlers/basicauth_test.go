@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func basicAuthRequest(user, pwd string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth(user, pwd)
+	return r
+}
+
+func TestBasicAuthHandlerRejectsBadScheme(t *testing.T) {
+	h := BasicAuthHandler(okHandler("secret"),
+		func(u, p string) (interface{}, bool) { return nil, true }, "", nil)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte("a:b")))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestBasicAuthHandlerThrottlesFailures(t *testing.T) {
+	limiter := NewTokenBucketRateLimiter(2, time.Hour)
+	h := BasicAuthHandler(okHandler("secret"),
+		func(u, p string) (interface{}, bool) { return nil, false }, "", limiter)
+
+	r := basicAuthRequest("alice", "wrong")
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d status = %d, want 401", i, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestBasicAuthHandlerThrottlesAcrossDifferentSourcePorts(t *testing.T) {
+	// A client that opens a fresh connection per attempt (the common
+	// brute-force pattern) gets a different ephemeral source port every
+	// time; the limiter must still key on the client's IP, not the whole
+	// RemoteAddr (which includes that port), or it never actually engages.
+	limiter := NewTokenBucketRateLimiter(2, time.Hour)
+	h := BasicAuthHandler(okHandler("secret"),
+		func(u, p string) (interface{}, bool) { return nil, false }, "", limiter)
+
+	newAttempt := func(port string) *http.Request {
+		r := basicAuthRequest("alice", "wrong")
+		r.RemoteAddr = "203.0.113.1:" + port
+		return r
+	}
+
+	for i, port := range []string{"51000", "51001"} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newAttempt(port))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d status = %d, want 401", i, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newAttempt("51002"))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want %d (throttled by IP, regardless of source port)", w.Code, http.StatusTooManyRequests)
+	}
+}
+
+func TestBasicAuthHandlerDoesNotClaimUnsupportedOptionalInterfaces(t *testing.T) {
+	// httptest.NewRecorder doesn't implement http.Hijacker, http.CloseNotifier
+	// or http.Pusher, so neither should the wrapped writer: claiming them
+	// unconditionally would make a caller's type assertion succeed and only
+	// fail later, at call time.
+	h := BasicAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); ok {
+			t.Fatal("wrapped writer claims http.Hijacker, but the underlying recorder does not support it")
+		}
+		if _, ok := w.(http.CloseNotifier); ok {
+			t.Fatal("wrapped writer claims http.CloseNotifier, but the underlying recorder does not support it")
+		}
+		if _, ok := w.(http.Pusher); ok {
+			t.Fatal("wrapped writer claims http.Pusher, but the underlying recorder does not support it")
+		}
+		if u, ok := GetUser(w); !ok || u != "alice" {
+			t.Fatalf("GetUser = %v, %v, want %q, true", u, ok, "alice")
+		}
+	}), func(u, p string) (interface{}, bool) { return "alice", true }, "", nil)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, basicAuthRequest("alice", "pw"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+}
+
+func TestBasicAuthHandlerThrottlesCorrectCredentialsOnceLimitIsReached(t *testing.T) {
+	limiter := NewTokenBucketRateLimiter(1, time.Hour)
+	ok := false
+	h := BasicAuthHandler(okHandler("secret"),
+		func(u, p string) (interface{}, bool) { return nil, ok }, "", limiter)
+
+	r := basicAuthRequest("alice", "pw")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r) // fails, consumes the only token
+
+	ok = true
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected throttling before a successful attempt clears it, got %d", w.Code)
+	}
+}
@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// EncodingFactory creates a compressing io.WriteCloser that writes to w.
+// Additional encodings (e.g. brotli) can be plugged into CompressHandler via
+// RegisterEncoding without this package taking a hard dependency on them.
+type EncodingFactory func(w io.Writer) io.WriteCloser
+
+type encoding struct {
+	name    string
+	factory EncodingFactory
+}
+
+// encodingRegistry holds the content-codings CompressHandler is willing to
+// negotiate. gzip and deflate are registered by default. encodingRegistryMu
+// guards it, since RegisterEncoding may run concurrently with in-flight
+// requests negotiating against it.
+var (
+	encodingRegistryMu sync.RWMutex
+	encodingRegistry   = map[string]*encoding{
+		"gzip": {
+			name:    "gzip",
+			factory: func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		},
+		"deflate": {
+			name: "deflate",
+			factory: func(w io.Writer) io.WriteCloser {
+				fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+				return fw
+			},
+		},
+	}
+)
+
+// RegisterEncoding adds, or replaces, a content-coding that CompressHandler
+// may select during negotiation. This lets callers wire up brotli (or any
+// other io.WriteCloser-based compressor) without this package importing it
+// directly. Safe to call while CompressHandler is already serving traffic.
+func RegisterEncoding(name string, factory EncodingFactory) {
+	name = strings.ToLower(name)
+	encodingRegistryMu.Lock()
+	defer encodingRegistryMu.Unlock()
+	encodingRegistry[name] = &encoding{name: name, factory: factory}
+}
+
+// lookupEncoding returns the registered encoding for name, if any.
+func lookupEncoding(name string) *encoding {
+	encodingRegistryMu.RLock()
+	defer encodingRegistryMu.RUnlock()
+	return encodingRegistry[name]
+}
+
+// registeredEncodings returns a snapshot of every registered encoding, for
+// iterating over without holding the registry lock.
+func registeredEncodings() []*encoding {
+	encodingRegistryMu.RLock()
+	defer encodingRegistryMu.RUnlock()
+	out := make([]*encoding, 0, len(encodingRegistry))
+	for _, e := range encodingRegistry {
+		out = append(out, e)
+	}
+	return out
+}
+
+// compressOptions holds the configuration assembled from a CompressHandler's
+// CompressOptions.
+type compressOptions struct {
+	minLength   int
+	preferOrder []string
+	mimeAllow   []string
+	mimeDeny    []string
+}
+
+func defaultCompressOptions() *compressOptions {
+	return &compressOptions{
+		preferOrder: []string{"br", "gzip", "deflate"},
+		mimeDeny:    []string{"image/*", "video/*"},
+	}
+}
+
+// CompressOption configures a CompressHandler.
+type CompressOption func(*compressOptions)
+
+// CompressMinLength skips compression for responses whose body totals fewer
+// than n bytes: Writes are buffered until n bytes have arrived, and a
+// response that ends before that is sent uncompressed.
+func CompressMinLength(n int) CompressOption {
+	return func(o *compressOptions) { o.minLength = n }
+}
+
+// CompressPreferOrder sets the tie-break order used when the client's
+// Accept-Encoding header weighs two or more supported encodings equally,
+// most preferred first. Names not in this list lose every tie.
+func CompressPreferOrder(names ...string) CompressOption {
+	return func(o *compressOptions) {
+		lower := make([]string, len(names))
+		for i, n := range names {
+			lower[i] = strings.ToLower(n)
+		}
+		o.preferOrder = lower
+	}
+}
+
+// CompressMIMEAllow restricts compression to the given MIME types (or
+// "type/*" wildcards). When set, it is authoritative: a type it matches is
+// compressed even if CompressMIMEDeny (or the built-in image/*, video/*
+// denylist) would otherwise exclude it, and a type it doesn't match is
+// served uncompressed regardless of the denylist.
+func CompressMIMEAllow(types ...string) CompressOption {
+	return func(o *compressOptions) { o.mimeAllow = types }
+}
+
+// CompressMIMEDeny skips compression for the given MIME types (or "type/*"
+// wildcards), on top of the built-in image/* and video/* denylist.
+func CompressMIMEDeny(types ...string) CompressOption {
+	return func(o *compressOptions) { o.mimeDeny = append(o.mimeDeny, types...) }
+}
+
+// CompressHandler returns a handler that content-negotiates a compression
+// scheme for the response body, per RFC 7231's Accept-Encoding. gzip and
+// deflate are supported out of the box; use RegisterEncoding to add others.
+func CompressHandler(h http.Handler, opts ...CompressOption) http.Handler {
+	cfg := defaultCompressOptions()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := w.(*compressResponseWriter); ok {
+				// Self-awareness, already wrapped, ignore
+				h.ServeHTTP(w, r)
+				return
+			}
+			setVaryHeader(w.Header())
+
+			acc := r.Header.Get("Accept-Encoding")
+			if r.Method == "HEAD" || acc == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			enc := negotiateEncoding(acc, cfg.preferOrder)
+			if enc == nil {
+				// Nothing we support (or the client asked for q=0 on everything)
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressResponseWriter{ResponseWriter: w, enc: enc, cfg: cfg}
+			defer cw.Close()
+			h.ServeHTTP(cw, r)
+		})
+}
+
+// acceptedEncoding is a single comma-separated entry of an Accept-Encoding
+// header, with its qvalue (defaulting to 1.0 when absent).
+type acceptedEncoding struct {
+	name string
+	q    float64
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header per RFC 7231 section
+// 5.3.4. Entries with q=0 are kept (with q=0) rather than dropped, because
+// an explicit "coding;q=0" must still exclude that coding even if a later
+// "*" entry would otherwise have picked it up.
+func parseAcceptEncoding(hdr string) []acceptedEncoding {
+	var out []acceptedEncoding
+	for _, part := range strings.Split(hdr, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		pieces := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(pieces[0]))
+		q := 1.0
+		for _, p := range pieces[1:] {
+			p = strings.TrimSpace(p)
+			val := strings.TrimPrefix(p, "q=")
+			if val == p {
+				continue // not a qvalue parameter
+			}
+			if parsed, err := strconv.ParseFloat(val, 64); err == nil {
+				q = parsed
+			}
+		}
+		out = append(out, acceptedEncoding{name: name, q: q})
+	}
+	return out
+}
+
+// negotiateEncoding picks the best registered encoding for the given
+// Accept-Encoding header, breaking ties using preferOrder (most preferred
+// first). It returns nil if nothing offered is supported. An encoding
+// explicitly given q=0 is never selected, even via a later "*" entry with a
+// nonzero qvalue: RFC 7231 treats an explicit coding as taking precedence
+// over "*" regardless of header order.
+func negotiateEncoding(hdr string, preferOrder []string) *encoding {
+	rank := make(map[string]int, len(preferOrder))
+	for i, name := range preferOrder {
+		rank[name] = len(preferOrder) - i
+	}
+
+	accepted := parseAcceptEncoding(hdr)
+	excluded := make(map[string]bool)
+	for _, a := range accepted {
+		if a.q == 0 && a.name != "*" {
+			excluded[a.name] = true
+		}
+	}
+
+	var best *encoding
+	var bestQ float64
+	var bestRank int
+	consider := func(e *encoding, q float64) {
+		if e == nil || excluded[e.name] {
+			return
+		}
+		r := rank[e.name]
+		if best == nil || q > bestQ || (q == bestQ && r > bestRank) {
+			best, bestQ, bestRank = e, q, r
+		}
+	}
+
+	for _, a := range accepted {
+		if a.q == 0 {
+			continue
+		}
+		if a.name == "*" {
+			for _, e := range registeredEncodings() {
+				consider(e, a.q)
+			}
+			continue
+		}
+		consider(lookupEncoding(a.name), a.q)
+	}
+	return best
+}
+
+// compressResponseWriter defers the decision to compress until enough of the
+// body is known: it buffers the first Write until minLength is reached (or
+// the handler finishes), and consults Content-Type once headers are set.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	cfg        *compressOptions
+	enc        *encoding
+	compressor io.WriteCloser
+	buf        []byte
+	status     int
+	skipped    bool
+	wroteHdr   bool
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if w.compressor == nil && !w.skipped {
+		if w.alreadyEncoded() || w.mimeExcluded() {
+			w.skipped = true
+		} else {
+			w.buf = append(w.buf, b...)
+			if len(w.buf) < w.cfg.minLength {
+				return len(b), nil
+			}
+			return w.startCompressing(len(b))
+		}
+	}
+	w.flushHeader()
+	if w.compressor != nil {
+		return w.compressor.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// alreadyEncoded reports whether the wrapped handler already set a
+// non-identity Content-Encoding itself (e.g. it served a pre-gzipped asset,
+// or proxied an already-compressed upstream response), in which case its
+// body must pass through unchanged rather than being compressed again.
+func (w *compressResponseWriter) alreadyEncoded() bool {
+	enc := w.Header().Get("Content-Encoding")
+	return enc != "" && !strings.EqualFold(enc, "identity")
+}
+
+func (w *compressResponseWriter) mimeExcluded() bool {
+	ct := w.Header().Get("Content-Type")
+	if ct == "" {
+		return false
+	}
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mt = ct
+	}
+	if len(w.cfg.mimeAllow) > 0 {
+		// An explicit allowlist overrides the denylist entirely.
+		return !matchesAnyMIME(mt, w.cfg.mimeAllow)
+	}
+	return matchesAnyMIME(mt, w.cfg.mimeDeny)
+}
+
+func matchesAnyMIME(mt string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "/*") {
+			if strings.HasPrefix(mt, strings.TrimSuffix(p, "*")) {
+				return true
+			}
+			continue
+		}
+		if mt == p {
+			return true
+		}
+	}
+	return false
+}
+
+// startCompressing flushes the buffered body (built up across however many
+// Write calls it took to reach minLength) through a freshly created
+// compressor. curLen is the length of the slice passed to the Write call
+// that triggered this, so the return value honors io.Writer's contract of
+// reporting how much of that call's own bytes were written, not the size of
+// the whole accumulated buffer.
+func (w *compressResponseWriter) startCompressing(curLen int) (int, error) {
+	prevLen := len(w.buf) - curLen
+	w.Header().Set("Content-Encoding", w.enc.name)
+	w.Header().Del("Content-Length")
+	w.compressor = w.enc.factory(w.ResponseWriter)
+	w.flushHeader()
+	n, err := w.compressor.Write(w.buf)
+	w.buf = nil
+
+	written := n - prevLen
+	if written < 0 {
+		written = 0
+	}
+	if written > curLen {
+		written = curLen
+	}
+	if err != nil {
+		return written, err
+	}
+	return curLen, nil
+}
+
+func (w *compressResponseWriter) flushHeader() {
+	if w.wroteHdr {
+		return
+	}
+	w.wroteHdr = true
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// Close flushes any buffered, not-yet-compressed bytes and closes the
+// compressor, if one was started.
+func (w *compressResponseWriter) Close() error {
+	if w.compressor == nil {
+		w.flushHeader()
+		if len(w.buf) > 0 {
+			_, err := w.ResponseWriter.Write(w.buf)
+			w.buf = nil
+			return err
+		}
+		return nil
+	}
+	return w.compressor.Close()
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func compressRequest(acceptEncoding string) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", acceptEncoding)
+	return r
+}
+
+func TestNegotiateEncodingQValueTies(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		preferOrder []string
+		want        string // "" means nil
+	}{
+		{"higher q wins", "deflate;q=0.5, gzip;q=0.8", nil, "gzip"},
+		{"tie broken by preferOrder", "deflate;q=0.5, gzip;q=0.5", []string{"deflate", "gzip"}, "deflate"},
+		{"wildcard matches anything", "*;q=0.3", []string{"gzip", "deflate"}, "gzip"},
+		{"unsupported coding ignored", "br;q=1.0", []string{"gzip", "deflate"}, ""},
+		{"no header entries", "", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := negotiateEncoding(tt.header, tt.preferOrder)
+			if tt.want == "" {
+				if got != nil {
+					t.Fatalf("negotiateEncoding(%q) = %v, want nil", tt.header, got.name)
+				}
+				return
+			}
+			if got == nil || got.name != tt.want {
+				t.Fatalf("negotiateEncoding(%q) = %v, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateEncodingExplicitQZeroExcludesWildcard(t *testing.T) {
+	got := negotiateEncoding("gzip;q=0, *;q=0.5", []string{"gzip", "deflate"})
+	if got == nil || got.name != "deflate" {
+		t.Fatalf("negotiateEncoding = %v, want deflate (gzip explicitly excluded)", got)
+	}
+}
+
+func TestNegotiateEncodingWildcardQZeroExcludesEverythingElse(t *testing.T) {
+	got := negotiateEncoding("gzip;q=0.5, *;q=0", []string{"gzip", "deflate"})
+	if got == nil || got.name != "gzip" {
+		t.Fatalf("negotiateEncoding = %v, want gzip (explicitly listed, unaffected by *;q=0)", got)
+	}
+
+	got = negotiateEncoding("*;q=0", []string{"gzip", "deflate"})
+	if got != nil {
+		t.Fatalf("negotiateEncoding = %v, want nil", got)
+	}
+}
+
+func TestCompressHandlerMinLengthBuffersShortResponses(t *testing.T) {
+	h := CompressHandler(okHandler("short"), CompressMinLength(100))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, compressRequest("gzip"))
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("Content-Encoding = %q, want empty (below min length)", enc)
+	}
+	if w.Body.String() != "short" {
+		t.Fatalf("body = %q, want %q", w.Body.String(), "short")
+	}
+}
+
+func TestCompressHandlerMinLengthCompressesLongResponses(t *testing.T) {
+	body := strings.Repeat("x", 200)
+	h := CompressHandler(okHandler(body), CompressMinLength(100))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, compressRequest("gzip"))
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", enc)
+	}
+}
+
+func TestCompressHandlerMIMEDenylist(t *testing.T) {
+	h := CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("binary-ish"))
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, compressRequest("gzip"))
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("Content-Encoding = %q, want empty (image/* denied by default)", enc)
+	}
+}
+
+func TestCompressHandlerMIMEAllowlistOverridesDenylist(t *testing.T) {
+	h := CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write([]byte("<svg></svg>"))
+	}), CompressMIMEAllow("image/svg+xml"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, compressRequest("gzip"))
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip (explicit allow overrides default deny)", enc)
+	}
+}
+
+func TestCompressHandlerMIMEAllowlistExcludesUnlisted(t *testing.T) {
+	h := CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("plain text"))
+	}), CompressMIMEAllow("application/json"))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, compressRequest("gzip"))
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("Content-Encoding = %q, want empty (text/plain not in allowlist)", enc)
+	}
+}
+
+func TestCompressHandlerBypassesAlreadyEncodedBody(t *testing.T) {
+	var buf strings.Builder
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("already-gzipped-bytes, padded to exceed the default minLength"))
+	gz.Close()
+	preEncoded := buf.String()
+
+	h := CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(preEncoded)))
+		w.Write([]byte(preEncoded))
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, compressRequest("gzip"))
+
+	if got := w.Body.String(); got != preEncoded {
+		t.Fatalf("body = %q, want untouched %q", got, preEncoded)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(preEncoded)) {
+		t.Fatalf("Content-Length = %q, want preserved %d", cl, len(preEncoded))
+	}
+}
+
+func TestCompressHandlerWriteReturnsCountForCurrentCallOnly(t *testing.T) {
+	var cw *compressResponseWriter
+	h := CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw = w.(*compressResponseWriter)
+		for i := 0; i < 3; i++ {
+			n, err := w.Write([]byte("ab"))
+			if err != nil {
+				t.Fatalf("Write: %v", err)
+			}
+			if n != 2 {
+				t.Fatalf("Write call %d returned n = %d, want 2 (the length of this call's own slice)", i, n)
+			}
+		}
+	}), CompressMinLength(5))
+
+	h.ServeHTTP(httptest.NewRecorder(), compressRequest("gzip"))
+	if cw.compressor == nil {
+		t.Fatal("expected minLength to have been reached and compression started")
+	}
+}
+
+func TestCompressHandlerRoundTrip(t *testing.T) {
+	body := strings.Repeat("hello compress ", 50)
+	h := CompressHandler(okHandler(body))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, compressRequest("gzip"))
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", enc)
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	got, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("reading gzip body: %v", err)
+	}
+	if string(got) != body {
+		t.Fatalf("got %q, want %q", got, body)
+	}
+}
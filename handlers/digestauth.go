@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NonceStore tracks server nonces and which nonce-counts (nc) have already
+// been used for each, so DigestAuthHandler can detect replayed requests and
+// expire stale challenges. Implementations must be safe for concurrent use.
+type NonceStore interface {
+	// New mints and records a fresh server nonce.
+	New() string
+	// Check reports whether nonce is known, unexpired, and nc has not
+	// already been used with it, recording nc as used on success.
+	Check(nonce, nc string) bool
+	// Stale reports whether nonce was once valid but has since expired,
+	// which tells the handler to ask for a fresh nonce instead of
+	// rejecting the credentials outright.
+	Stale(nonce string) bool
+}
+
+// memoryNonceEntry tracks one nonce's expiry and the nonce-counts it has
+// already served, for replay detection.
+type memoryNonceEntry struct {
+	expires time.Time
+	seen    map[string]bool
+}
+
+// memoryNonceStore is the default in-memory NonceStore. Nonces expire ttl
+// after being issued.
+type memoryNonceStore struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]*memoryNonceEntry
+	issued map[string]bool // nonces that existed at some point, for Stale
+}
+
+// NewMemoryNonceStore returns a NonceStore that keeps nonces in memory and
+// expires them after ttl.
+func NewMemoryNonceStore(ttl time.Duration) NonceStore {
+	return &memoryNonceStore{
+		ttl:    ttl,
+		nonces: make(map[string]*memoryNonceEntry),
+		issued: make(map[string]bool),
+	}
+}
+
+func (s *memoryNonceStore) New() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gcLocked()
+	s.nonces[nonce] = &memoryNonceEntry{
+		expires: time.Now().Add(s.ttl),
+		seen:    make(map[string]bool),
+	}
+	s.issued[nonce] = true
+	return nonce
+}
+
+func (s *memoryNonceStore) Check(nonce, nc string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.nonces[nonce]
+	if !ok || time.Now().After(e.expires) {
+		return false
+	}
+	if nc != "" {
+		if e.seen[nc] {
+			return false
+		}
+		e.seen[nc] = true
+	}
+	return true
+}
+
+func (s *memoryNonceStore) Stale(nonce string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.nonces[nonce]
+	return s.issued[nonce] && ok && time.Now().After(e.expires)
+}
+
+func (s *memoryNonceStore) gcLocked() {
+	now := time.Now()
+	for n, e := range s.nonces {
+		// Expired nonces are kept for one more ttl so Stale can still
+		// recognise them; Check already rejects them by their expiry.
+		if now.After(e.expires.Add(s.ttl)) {
+			delete(s.nonces, n)
+			delete(s.issued, n)
+		}
+	}
+}
+
+// digestAlgorithm pairs an RFC 7616 algorithm token with its hash
+// constructor.
+type digestAlgorithm struct {
+	token string
+	new   func() hash.Hash
+}
+
+var digestAlgorithms = []digestAlgorithm{
+	{token: "SHA-256", new: sha256.New},
+	{token: "MD5", new: md5.New},
+}
+
+func hexHash(h hash.Hash, parts ...string) string {
+	h.Reset()
+	io.WriteString(h, strings.Join(parts, ":"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DigestAuthHandler returns an http.Handler implementing RFC 7616 HTTP
+// Digest Authentication (qop=auth, with MD5 and SHA-256) in front of h.
+//
+// authFn looks up the HA1 for a username, for the algorithm the client
+// negotiated (algorithm is "MD5" or "SHA-256"), as
+// HA1 = <algorithm>(username:realm:password), so callers never need to store
+// plaintext passwords; ok is false if the user is unknown. Per RFC 7616
+// §3.4.2, MD5 and SHA-256 HA1s are independent digests of the same
+// username:realm:password - re-hashing one algorithm's HA1 with the other
+// does not produce a valid HA1, so callers supporting both algorithms must
+// be able to produce the algorithm-appropriate one (e.g. by storing both, or
+// deriving SHA-256's from the plaintext password at auth time).
+//
+// store tracks nonces and their use; pass nil to use an in-memory store with
+// a 5 minute nonce lifetime. Once authenticated, GetUser returns the
+// userData authFn supplied, exactly as it does for BasicAuthHandler.
+func DigestAuthHandler(h http.Handler,
+	authFn func(username, realm, algorithm string) (ha1 string, userData interface{}, ok bool),
+	realm string, store NonceStore) http.Handler {
+
+	if realm == "" {
+		realm = "Authorization Required"
+	}
+	if store == nil {
+		store = NewMemoryNonceStore(5 * time.Minute)
+	}
+
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Self-awareness
+			if _, ok := GetUser(w); ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			cred, ok := parseDigestAuthorization(r.Header.Get("Authorization"))
+			if !ok {
+				digestChallenge(w, realm, store, "")
+				return
+			}
+
+			algo := digestAlgorithmByToken(cred["algorithm"])
+			ha1, udata, ok := authFn(cred["username"], realm, algo.token)
+			if !ok {
+				digestChallenge(w, realm, store, "")
+				return
+			}
+
+			if !store.Check(cred["nonce"], cred["nc"]) {
+				stale := "false"
+				if store.Stale(cred["nonce"]) {
+					stale = "true"
+				}
+				digestChallenge(w, realm, store, stale)
+				return
+			}
+			if !validDigestResponse(algo, ha1, r.Method, cred) {
+				digestChallenge(w, realm, store, "")
+				return
+			}
+
+			uw := wrapUserWriter(w, udata)
+			h.ServeHTTP(uw, r)
+		})
+}
+
+// parseDigestAuthorization splits the Authorization header of a Digest
+// request into its named fields, e.g. {"username": "...", "nonce": "..."}.
+func parseDigestAuthorization(hdr string) (map[string]string, bool) {
+	if !strings.HasPrefix(hdr, "Digest ") {
+		return nil, false
+	}
+	cred := make(map[string]string)
+	for _, part := range splitDigestParams(strings.TrimPrefix(hdr, "Digest ")) {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		cred[kv[0]] = strings.Trim(kv[1], `"`)
+	}
+	for _, required := range []string{"username", "realm", "nonce", "uri", "response"} {
+		if cred[required] == "" {
+			return nil, false
+		}
+	}
+	return cred, true
+}
+
+// splitDigestParams splits a comma-separated Digest field list without
+// breaking on commas inside quoted values (e.g. the client's URI).
+func splitDigestParams(s string) []string {
+	var parts []string
+	var quoted bool
+	start := 0
+	for i, r := range s {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, s[start:])
+	return parts
+}
+
+func digestAlgorithmByToken(token string) digestAlgorithm {
+	for _, a := range digestAlgorithms {
+		if strings.EqualFold(a.token, token) {
+			return a
+		}
+	}
+	return digestAlgorithms[len(digestAlgorithms)-1] // MD5, RFC 7616's default
+}
+
+// validDigestResponse recomputes the expected digest response and compares
+// it to the client's in constant time.
+func validDigestResponse(algo digestAlgorithm, ha1, method string, cred map[string]string) bool {
+	if cred["qop"] != "" && cred["qop"] != "auth" {
+		return false
+	}
+	ha2 := hexHash(algo.new(), method, cred["uri"])
+
+	var want string
+	if cred["qop"] == "auth" {
+		want = hexHash(algo.new(), ha1, cred["nonce"], cred["nc"], cred["cnonce"], cred["qop"], ha2)
+	} else {
+		want = hexHash(algo.new(), ha1, cred["nonce"], ha2)
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(cred["response"])) == 1
+}
+
+// digestChallenge writes a 401 with one WWW-Authenticate challenge per
+// supported algorithm, each with its own freshly minted nonce; all of them
+// share one opaque value.
+// stale, when "true" or "false", is echoed verbatim per RFC 7616 section 3.3.
+func digestChallenge(w http.ResponseWriter, realm string, store NonceStore, stale string) {
+	opaque := make([]byte, 8)
+	rand.Read(opaque)
+	for _, algo := range digestAlgorithms {
+		nonce := store.New()
+		challenge := fmt.Sprintf(
+			`Digest realm="%s", qop="auth", algorithm=%s, nonce="%s", opaque="%s"`,
+			realm, algo.token, nonce, hex.EncodeToString(opaque))
+		if stale != "" {
+			challenge += fmt.Sprintf(`, stale=%s`, stale)
+		}
+		w.Header().Add("WWW-Authenticate", challenge)
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte("Unauthorized"))
+}
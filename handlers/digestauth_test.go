@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func ha1MD5(username, realm, password string) string {
+	h := md5.Sum([]byte(username + ":" + realm + ":" + password))
+	return hex.EncodeToString(h[:])
+}
+
+func ha1SHA256(username, realm, password string) string {
+	h := sha256.Sum256([]byte(username + ":" + realm + ":" + password))
+	return hex.EncodeToString(h[:])
+}
+
+var wwwAuthParam = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,]+))`)
+
+func parseWWWAuthenticate(hdr string) map[string]string {
+	out := make(map[string]string)
+	for _, m := range wwwAuthParam.FindAllStringSubmatch(hdr, -1) {
+		if m[2] != "" {
+			out[m[1]] = m[2]
+		} else {
+			out[m[1]] = m[3]
+		}
+	}
+	return out
+}
+
+func TestDigestAuthHandlerRoundTrip(t *testing.T) {
+	const username, realm, password, uri = "alice", "Authorization Required", "secret", "/protected"
+	authFn := func(u, r, algorithm string) (string, interface{}, bool) {
+		if u != username {
+			return "", nil, false
+		}
+		if algorithm == "SHA-256" {
+			return ha1SHA256(username, realm, password), "alice-data", true
+		}
+		return ha1MD5(username, realm, password), "alice-data", true
+	}
+
+	h := DigestAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetUser(w)
+		if !ok || u != "alice-data" {
+			t.Errorf("GetUser = %v, %v", u, ok)
+		}
+		w.Write([]byte("ok"))
+	}), authFn, realm, nil)
+
+	// First request: no Authorization header, expect a challenge.
+	r1 := httptest.NewRequest("GET", uri, nil)
+	w1 := httptest.NewRecorder()
+	h.ServeHTTP(w1, r1)
+	if w1.Code != http.StatusUnauthorized {
+		t.Fatalf("first request status = %d, want 401", w1.Code)
+	}
+
+	var md5Challenge map[string]string
+	for _, hdr := range w1.Result().Header["Www-Authenticate"] {
+		p := parseWWWAuthenticate(hdr)
+		if p["algorithm"] == "MD5" {
+			md5Challenge = p
+		}
+	}
+	if md5Challenge == nil {
+		t.Fatal("no MD5 challenge in WWW-Authenticate")
+	}
+
+	nonce, opaque := md5Challenge["nonce"], md5Challenge["opaque"]
+	ha1 := ha1MD5(username, realm, password)
+	ha2 := ha1MD5FromParts("GET", uri)
+	cnonce, nc := "cnonce123", "00000001"
+	response := hexHashMD5(ha1, nonce, nc, cnonce, "auth", ha2)
+
+	authz := fmt.Sprintf(
+		`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5, response="%s", qop=auth, nc=%s, cnonce="%s", opaque="%s"`,
+		username, realm, nonce, uri, response, nc, cnonce, opaque)
+
+	r2 := httptest.NewRequest("GET", uri, nil)
+	r2.Header.Set("Authorization", authz)
+	w2 := httptest.NewRecorder()
+	h.ServeHTTP(w2, r2)
+
+	if w2.Code != http.StatusOK {
+		t.Fatalf("second request status = %d, body %q", w2.Code, w2.Body.String())
+	}
+	if w2.Body.String() != "ok" {
+		t.Fatalf("body = %q, want %q", w2.Body.String(), "ok")
+	}
+}
+
+func ha1MD5FromParts(parts ...string) string {
+	h := md5.New()
+	for i, p := range parts {
+		if i > 0 {
+			h.Write([]byte(":"))
+		}
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hexHashSHA256(parts ...string) string {
+	h := sha256.New()
+	for i, p := range parts {
+		if i > 0 {
+			h.Write([]byte(":"))
+		}
+		h.Write([]byte(p))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// TestDigestAuthHandlerRoundTripSHA256 authenticates the way a
+// standards-compliant RFC 7616 SHA-256 client would: HA1 = SHA-256(user:
+// realm:password), not a re-hash of the MD5 HA1. A client built this way
+// must be able to authenticate against the SHA-256 challenge.
+func TestDigestAuthHandlerRoundTripSHA256(t *testing.T) {
+	const username, realm, password, uri = "alice", "Authorization Required", "secret", "/protected"
+	authFn := func(u, r, algorithm string) (string, interface{}, bool) {
+		if u != username {
+			return "", nil, false
+		}
+		if algorithm == "SHA-256" {
+			return ha1SHA256(username, realm, password), "alice-data", true
+		}
+		return ha1MD5(username, realm, password), "alice-data", true
+	}
+
+	h := DigestAuthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, ok := GetUser(w)
+		if !ok || u != "alice-data" {
+			t.Errorf("GetUser = %v, %v", u, ok)
+		}
+		w.Write([]byte("ok"))
+	}), authFn, realm, nil)
+
+	r1 := httptest.NewRequest("GET", uri, nil)
+	w1 := httptest.NewRecorder()
+	h.ServeHTTP(w1, r1)
+	if w1.Code != http.StatusUnauthorized {
+		t.Fatalf("first request status = %d, want 401", w1.Code)
+	}
+
+	var sha256Challenge map[string]string
+	for _, hdr := range w1.Result().Header["Www-Authenticate"] {
+		p := parseWWWAuthenticate(hdr)
+		if p["algorithm"] == "SHA-256" {
+			sha256Challenge = p
+		}
+	}
+	if sha256Challenge == nil {
+		t.Fatal("no SHA-256 challenge in WWW-Authenticate")
+	}
+
+	nonce, opaque := sha256Challenge["nonce"], sha256Challenge["opaque"]
+	ha1 := ha1SHA256(username, realm, password)
+	ha2 := hexHashSHA256("GET", uri)
+	cnonce, nc := "cnonce123", "00000001"
+	response := hexHashSHA256(ha1, nonce, nc, cnonce, "auth", ha2)
+
+	authz := fmt.Sprintf(
+		`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=SHA-256, response="%s", qop=auth, nc=%s, cnonce="%s", opaque="%s"`,
+		username, realm, nonce, uri, response, nc, cnonce, opaque)
+
+	r2 := httptest.NewRequest("GET", uri, nil)
+	r2.Header.Set("Authorization", authz)
+	w2 := httptest.NewRecorder()
+	h.ServeHTTP(w2, r2)
+
+	if w2.Code != http.StatusOK {
+		t.Fatalf("second request status = %d, body %q", w2.Code, w2.Body.String())
+	}
+	if w2.Body.String() != "ok" {
+		t.Fatalf("body = %q, want %q", w2.Body.String(), "ok")
+	}
+}
+
+func hexHashMD5(parts ...string) string {
+	return ha1MD5FromParts(parts...)
+}
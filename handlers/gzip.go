@@ -2,9 +2,11 @@ package handlers
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 )
 
 // Thanks to Andrew Gerrand for inspiration:
@@ -18,28 +20,248 @@ import (
 
 // Internal gzipped writer that satisfies both the (body) writer in gzipped format,
 // and maintains the rest of the ResponseWriter interface for header manipulation.
+//
+// It defers the actual decision to compress until the first Write (or Flush)
+// call, WriteHeader only recording the status, so it can notice that the
+// wrapped handler already set a
+// non-identity Content-Encoding itself (e.g. it served a pre-gzipped asset,
+// or proxied an already-compressed upstream response) and pass those bytes
+// through unchanged rather than gzipping an already-gzipped body.
+//
+// It does not implement http.Hijacker, http.CloseNotifier or http.Pusher
+// itself - those are only ever optional, and wrapGzipWriter picks one of the
+// variants below to add exactly the ones the wrapped ResponseWriter supports.
 type gzipResponseWriter struct {
-	io.Writer
 	http.ResponseWriter
+	pool *sync.Pool
+
+	gz         *gzip.Writer
+	status     int
+	decided    bool
+	bypass     bool
+	hdrWritten bool
+	hijacked   bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.status = status
 }
 
-// Unambiguous Write() implementation (otherwise both ResponseWriter and Writer
-// want to claim this method).
 func (w *gzipResponseWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
+	if !w.decided {
+		w.decide()
+	}
+	w.flushHeader()
+	if w.bypass {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// decide inspects the headers set so far (by us and by the wrapped handler)
+// and picks whether to gzip the body or bypass compression entirely.
+func (w *gzipResponseWriter) decide() {
+	w.decided = true
+	if enc := w.Header().Get("Content-Encoding"); enc != "" && !strings.EqualFold(enc, "identity") {
+		w.bypass = true
+		return
+	}
+	setGzipHeaders(w.Header())
+	w.gz = w.pool.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+}
+
+func (w *gzipResponseWriter) flushHeader() {
+	if w.hdrWritten {
+		return
+	}
+	w.hdrWritten = true
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// Close finishes the response: flushing and releasing the pooled gzip
+// writer if one was started, or just sending the buffered status otherwise.
+func (w *gzipResponseWriter) Close() error {
+	if w.hijacked {
+		// The connection no longer belongs to the HTTP server; touching
+		// ResponseWriter further (even just WriteHeader) is invalid.
+		return nil
+	}
+	if !w.decided {
+		// Nothing was ever written (e.g. a bare WriteHeader(204)); there is
+		// nothing to decide and nothing to compress.
+		w.flushHeader()
+		return nil
+	}
+	if w.bypass {
+		return nil
+	}
+	err := w.gz.Close()
+	w.pool.Put(w.gz)
+	return err
+}
+
+// Flush flushes the gzip writer before flushing the underlying
+// ResponseWriter, so partial responses actually reach the client instead of
+// sitting in the gzip buffer.
+func (w *gzipResponseWriter) Flush() {
+	if !w.decided {
+		w.decide()
+	}
+	w.flushHeader()
+	if !w.bypass {
+		w.gz.Flush()
+	}
+	flush(w.ResponseWriter)
+}
+
+// isGzipResponseWriter marks every wrapper variant below (they all embed
+// *gzipResponseWriter) so GZIPHandlerLevel's self-awareness check keeps
+// working no matter which variant was chosen for the current writer.
+func (w *gzipResponseWriter) isGzipResponseWriter() {}
+
+type gzipWriter interface {
+	http.ResponseWriter
+	isGzipResponseWriter()
 }
 
-// Gzip compression HTTP handler.
+// gzipWriteCloser is what wrapGzipWriter hands back: every variant embeds
+// *gzipResponseWriter, so Close (and the gzipWriter marker) come along for
+// free regardless of which optional interfaces it also implements.
+type gzipWriteCloser interface {
+	gzipWriter
+	Close() error
+}
+
+// The 2^3 combinations of http.Hijacker, http.CloseNotifier and http.Pusher
+// a wrapped ResponseWriter may or may not support, built from the mixins in
+// optional_interfaces.go. Each only forwards the optional interfaces its
+// inner writer actually implements - see wrapGzipWriter.
+type (
+	gzipPlainWriter struct {
+		*gzipResponseWriter
+	}
+	gzipHijackWriter struct {
+		*gzipResponseWriter
+		hijackerMixin
+	}
+	gzipCloseNotifyWriter struct {
+		*gzipResponseWriter
+		closeNotifierMixin
+	}
+	gzipPusherWriter struct {
+		*gzipResponseWriter
+		pusherMixin
+	}
+	gzipHijackCloseNotifyWriter struct {
+		*gzipResponseWriter
+		hijackerMixin
+		closeNotifierMixin
+	}
+	gzipHijackPusherWriter struct {
+		*gzipResponseWriter
+		hijackerMixin
+		pusherMixin
+	}
+	gzipCloseNotifyPusherWriter struct {
+		*gzipResponseWriter
+		closeNotifierMixin
+		pusherMixin
+	}
+	gzipHijackCloseNotifyPusherWriter struct {
+		*gzipResponseWriter
+		hijackerMixin
+		closeNotifierMixin
+		pusherMixin
+	}
+)
+
+// wrapGzipWriter wraps w for a single request, choosing the variant above
+// that matches which optional interfaces w itself implements.
+func wrapGzipWriter(w http.ResponseWriter, pool *sync.Pool) gzipWriteCloser {
+	core := &gzipResponseWriter{ResponseWriter: w, pool: pool}
+	_, isHijacker := w.(http.Hijacker)
+	_, isCloseNotifier := w.(http.CloseNotifier)
+	_, isPusher := w.(http.Pusher)
+
+	cn := closeNotifierMixin{inner: w}
+	ps := pusherMixin{inner: w}
+	var hj hijackerMixin
+	if isHijacker {
+		hj = hijackerMixin{inner: w, onHijack: func() { core.hijacked = true }}
+	}
+
+	switch {
+	case isHijacker && isCloseNotifier && isPusher:
+		return &gzipHijackCloseNotifyPusherWriter{core, hj, cn, ps}
+	case isHijacker && isCloseNotifier:
+		return &gzipHijackCloseNotifyWriter{core, hj, cn}
+	case isHijacker && isPusher:
+		return &gzipHijackPusherWriter{core, hj, ps}
+	case isCloseNotifier && isPusher:
+		return &gzipCloseNotifyPusherWriter{core, cn, ps}
+	case isHijacker:
+		return &gzipHijackWriter{core, hj}
+	case isCloseNotifier:
+		return &gzipCloseNotifyWriter{core, cn}
+	case isPusher:
+		return &gzipPusherWriter{core, ps}
+	default:
+		return &gzipPlainWriter{core}
+	}
+}
+
+// gzipWriterPools holds one *sync.Pool of *gzip.Writer per compression
+// level, so GZIPHandlerLevel can reuse writers across requests regardless of
+// which level each handler was built with.
+var (
+	gzipWriterPools   = map[int]*sync.Pool{}
+	gzipWriterPoolsMu sync.Mutex
+)
+
+// gzipWriterPool returns the shared pool for level, creating it on first use.
+func gzipWriterPool(level int) *sync.Pool {
+	gzipWriterPoolsMu.Lock()
+	defer gzipWriterPoolsMu.Unlock()
+	if pool, ok := gzipWriterPools[level]; ok {
+		return pool
+	}
+	pool := &sync.Pool{
+		New: func() interface{} {
+			gz, _ := gzip.NewWriterLevel(io.Discard, level)
+			return gz
+		},
+	}
+	gzipWriterPools[level] = pool
+	return pool
+}
+
+// Gzip compression HTTP handler, using gzip.DefaultCompression.
 func GZIPHandler(h http.Handler) http.Handler {
+	return GZIPHandlerLevel(h, gzip.DefaultCompression)
+}
+
+// GZIPHandlerLevel is like GZIPHandler but compresses at the given level,
+// which must be between gzip.BestSpeed and gzip.BestCompression, or
+// gzip.DefaultCompression. It panics if level is out of range; unlike
+// gzip.NewWriterLevel, it also rejects gzip.NoCompression and
+// gzip.HuffmanOnly.
+func GZIPHandlerLevel(h http.Handler, level int) http.Handler {
+	if level != gzip.DefaultCompression &&
+		(level < gzip.BestSpeed || level > gzip.BestCompression) {
+		panic(fmt.Sprintf("handlers: invalid gzip compression level %d", level))
+	}
+	pool := gzipWriterPool(level)
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
-			if _, ok := w.(*gzipResponseWriter); ok {
+			if _, ok := w.(gzipWriter); ok {
 				// Self-awareness, the ResponseWriter is already a gzip writer, ignore
 				h.ServeHTTP(w, r)
 				return
 			}
-			hdr := w.Header()
-			setVaryHeader(hdr)
+			setVaryHeader(w.Header())
 
 			// Do nothing on a HEAD request or if no accept-encoding is specified on the request
 			acc, ok := r.Header["Accept-Encoding"]
@@ -53,15 +275,11 @@ func GZIPHandler(h http.Handler) http.Handler {
 				return
 			}
 
-			// Prepare a gzip response container
-			setGzipHeaders(hdr)
-			gz := gzip.NewWriter(w)
-			defer gz.Close()
-			h.ServeHTTP(
-				&gzipResponseWriter{
-					Writer:         gz,
-					ResponseWriter: w,
-				}, r)
+			// The actual gzip writer is checked out of the pool lazily, once
+			// gzipResponseWriter decides the body isn't already encoded.
+			gw := wrapGzipWriter(w, pool)
+			defer gw.Close()
+			h.ServeHTTP(gw, r)
 		})
 }
 
@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func okHandler(body string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+}
+
+func gzipRequest() *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	return r
+}
+
+func TestGZIPHandlerFlushesGzipBeforeUnderlyingWriter(t *testing.T) {
+	var flushed bool
+	var atFlush []byte
+	h := GZIPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+	}))
+
+	rec := httptest.NewRecorder()
+	w := &flusherRecorder{ResponseRecorder: rec, onFlush: func() {
+		flushed = true
+		atFlush = append([]byte(nil), rec.Body.Bytes()...)
+	}}
+	h.ServeHTTP(w, gzipRequest())
+
+	if !flushed {
+		t.Fatal("expected the underlying Flusher to be called")
+	}
+	// What had reached the underlying writer by the time it was flushed must
+	// already decode to the partial body.
+	fr, err := gzip.NewReader(bytes.NewReader(atFlush))
+	if err != nil {
+		t.Fatalf("gzip.NewReader at flush time: %v", err)
+	}
+	if got, _ := io.ReadAll(fr); string(got) != "partial" {
+		t.Fatalf("at flush time got %q, want %q", got, "partial")
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	if got, _ := io.ReadAll(gr); string(got) != "partial" {
+		t.Fatalf("got %q, want %q", got, "partial")
+	}
+}
+
+type flusherRecorder struct {
+	*httptest.ResponseRecorder
+	onFlush func()
+}
+
+func (f *flusherRecorder) Flush() {
+	f.onFlush()
+}
+
+func TestGZIPHandlerDoesNotTouchResponseWriterAfterHijack(t *testing.T) {
+	h := GZIPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusSwitchingProtocols)
+		if _, _, err := w.(http.Hijacker).Hijack(); err != nil {
+			t.Fatalf("Hijack: %v", err)
+		}
+	}))
+
+	hw := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(hw, gzipRequest())
+
+	if hw.wroteAfterHijack {
+		t.Fatal("ResponseWriter was written to after Hijack returned")
+	}
+}
+
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked         bool
+	wroteAfterHijack bool
+}
+
+func (h *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.hijacked = true
+	server, _ := net.Pipe()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func (h *hijackRecorder) WriteHeader(status int) {
+	if h.hijacked {
+		h.wroteAfterHijack = true
+	}
+	h.ResponseRecorder.WriteHeader(status)
+}
+
+func TestGZIPHandlerDoesNotClaimUnsupportedOptionalInterfaces(t *testing.T) {
+	// httptest.NewRecorder implements http.Flusher but none of Hijacker,
+	// CloseNotifier or Pusher, so the wrapped writer must not claim them
+	// either: claiming them unconditionally would make a caller's type
+	// assertion succeed and only fail later, at call time.
+	h := GZIPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); ok {
+			t.Fatal("wrapped writer claims http.Hijacker, but the underlying recorder does not support it")
+		}
+		if _, ok := w.(http.CloseNotifier); ok {
+			t.Fatal("wrapped writer claims http.CloseNotifier, but the underlying recorder does not support it")
+		}
+		if _, ok := w.(http.Pusher); ok {
+			t.Fatal("wrapped writer claims http.Pusher, but the underlying recorder does not support it")
+		}
+		w.Write([]byte("x"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), gzipRequest())
+}
+
+func TestGZIPHandlerLevelInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected GZIPHandlerLevel to panic on an invalid level")
+		}
+	}()
+	GZIPHandlerLevel(okHandler("x"), 42)
+}
+
+func TestGZIPHandlerRoundTrip(t *testing.T) {
+	body := strings.Repeat("hello world ", 100)
+	h := GZIPHandler(okHandler(body))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, gzipRequest())
+
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", enc)
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	got, err := io.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("reading gzip body: %v", err)
+	}
+	if string(got) != body {
+		t.Fatalf("got %q, want %q", got, body)
+	}
+}
+
+func TestGZIPHandlerBypassesAlreadyEncodedBody(t *testing.T) {
+	preEncoded := []byte("already-gzipped-bytes")
+	h := GZIPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(len(preEncoded)))
+		w.Write(preEncoded)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, gzipRequest())
+
+	if got := w.Body.Bytes(); !bytes.Equal(got, preEncoded) {
+		t.Fatalf("body = %q, want untouched %q", got, preEncoded)
+	}
+	if cl := w.Header().Get("Content-Length"); cl != strconv.Itoa(len(preEncoded)) {
+		t.Fatalf("Content-Length = %q, want preserved %d", cl, len(preEncoded))
+	}
+}
+
+// BenchmarkGZIPHandlerPooled exercises the pooled GZIPHandlerLevel writer
+// path used by GZIPHandler.
+func BenchmarkGZIPHandlerPooled(b *testing.B) {
+	body := strings.Repeat("hello world ", 1000)
+	h := GZIPHandler(okHandler(body))
+	r := gzipRequest()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+	}
+}
+
+// BenchmarkGZIPHandlerUnpooled drives the same gzipResponseWriter path as
+// BenchmarkGZIPHandlerPooled, but against a fresh, always-empty pool so a
+// new gzip.Writer is allocated on every request, to isolate the pool's win.
+func BenchmarkGZIPHandlerUnpooled(b *testing.B) {
+	body := strings.Repeat("hello world ", 1000)
+	h := okHandler(body)
+	r := gzipRequest()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pool := &sync.Pool{
+			New: func() interface{} {
+				gz, _ := gzip.NewWriterLevel(io.Discard, gzip.DefaultCompression)
+				return gz
+			},
+		}
+		w := httptest.NewRecorder()
+		gw := &gzipResponseWriter{ResponseWriter: w, pool: pool}
+		h.ServeHTTP(gw, r)
+		gw.Close()
+	}
+}
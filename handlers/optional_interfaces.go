@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// hijack, flush, closeNotify and push forward the optional ResponseWriter
+// interfaces (http.Hijacker, http.Flusher, http.CloseNotifier, http.Pusher)
+// to inner when it implements them. gzipResponseWriter and
+// userResponseWriter share these so that WebSocket upgrades, SSE and HTTP/2
+// server push keep working when GZIPHandler or one of the auth handlers sits
+// in the middleware chain. compressResponseWriter forwards none of them.
+
+func hijack(inner http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := inner.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("handlers: underlying ResponseWriter does not support http.Hijacker")
+	}
+	return h.Hijack()
+}
+
+func flush(inner http.ResponseWriter) {
+	if f, ok := inner.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func closeNotify(inner http.ResponseWriter) <-chan bool {
+	cn, ok := inner.(http.CloseNotifier)
+	if !ok {
+		return nil
+	}
+	return cn.CloseNotify()
+}
+
+func push(inner http.ResponseWriter, target string, opts *http.PushOptions) error {
+	p, ok := inner.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
+
+// hijackerMixin, closeNotifierMixin and pusherMixin are embedded, in every
+// combination, into the wrapper variants in gzip.go and basicauth.go.
+//
+// Because Go interface satisfaction is static, a single wrapper type that
+// unconditionally implements http.Hijacker/http.CloseNotifier/http.Pusher
+// would make a caller's `w.(http.Hijacker)` type assertion succeed even when
+// the underlying ResponseWriter doesn't support it (e.g. over HTTP/2, where
+// Hijack is legitimately unavailable) - the failure would only surface at
+// call time. Precomputing one wrapper variant per combination of supported
+// optional interfaces, built from these mixins, keeps the assertion itself
+// honest instead.
+type hijackerMixin struct {
+	inner    http.ResponseWriter
+	onHijack func()
+}
+
+func (m hijackerMixin) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := hijack(m.inner)
+	if err == nil && m.onHijack != nil {
+		m.onHijack()
+	}
+	return conn, rw, err
+}
+
+type closeNotifierMixin struct {
+	inner http.ResponseWriter
+}
+
+func (m closeNotifierMixin) CloseNotify() <-chan bool {
+	return closeNotify(m.inner)
+}
+
+type pusherMixin struct {
+	inner http.ResponseWriter
+}
+
+func (m pusherMixin) Push(target string, opts *http.PushOptions) error {
+	return push(m.inner, target, opts)
+}
+
+// WrapWriter is implemented by ResponseWriter wrappers that expose the writer
+// they wrap (userResponseWriter in this package), so GetResponseWriter can
+// walk back through a chain of them to find the one it's after.
+// gzipResponseWriter and compressResponseWriter do not implement it, so a
+// walk that reaches one of them stops there.
+type WrapWriter interface {
+	http.ResponseWriter
+	WrappedWriter() http.ResponseWriter
+}
+
+// GetResponseWriter unwraps w through successive WrapWriter layers,
+// outermost first, returning the first ResponseWriter for which pred
+// returns true.
+func GetResponseWriter(w http.ResponseWriter, pred func(http.ResponseWriter) bool) (http.ResponseWriter, bool) {
+	for {
+		if pred(w) {
+			return w, true
+		}
+		ww, ok := w.(WrapWriter)
+		if !ok {
+			return nil, false
+		}
+		w = ww.WrappedWriter()
+	}
+}